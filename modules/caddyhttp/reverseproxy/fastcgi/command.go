@@ -20,7 +20,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -30,13 +33,14 @@ import (
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/rewrite"
+	"github.com/caddyserver/caddy/v2/modules/logging"
 )
 
 func init() {
 	caddycmd.RegisterCommand(caddycmd.Command{
 		Name:  "php-fastcgi",
 		Func:  cmdPHPFastCGI,
-		Usage: "[--from <addr>] [--to <addr>] --root <dir>",
+		Usage: "[--from <addr>] [--to <addr>,...] --root <dir>",
 		Short: "A quick and production-ready PHP FastCGI server",
 		Long: `
 A simple but production-ready PHP FastCGI server. Useful for quick deployments,
@@ -51,17 +55,113 @@ or port).
 
 The --root parameter needs to specified as a directory, equivalent to the
 "root" subdirective of php_fastcgi.
+
+The --to address may be given more than once, either as a comma-separated
+list or by repeating the flag, to load balance across a pool of FastCGI
+upstreams (such as a cluster of PHP-FPM workers). When more than one
+upstream is given, --lb-policy selects how requests are distributed among
+them, and --health-uri/--health-interval configure active health checking
+of the pool.
+
+A unix socket may be given as the --to address (e.g.
+unix:///run/php/php8.3-fpm.sock); Caddy checks that it is reachable before
+starting, and --unix-socket-mode can be set to verify its permissions
+match what's expected. Use --to-tls (and, for mutual TLS, --to-tls-ca,
+--to-tls-client-cert, and --to-tls-client-key) to encrypt the connection
+to a TCP upstream.
+
+By default, the front controller is assumed to be index.php and only
+.php files are executed; use --index, --ext, and --try-files (each
+repeatable) to support other front controllers and rewrite rules, and
+--env (repeatable, KEY=VALUE) to set environment variables passed to the
+FastCGI process.
+
+Use --access-log to enable access logging (--access-log-format chooses
+between "console" and "json"), and --metrics to expose Prometheus metrics
+and enable the admin API, for production observability.
 `,
 		Flags: func() *flag.FlagSet {
 			fs := flag.NewFlagSet("php-fastcgi", flag.ExitOnError)
 			fs.String("from", "localhost", "Address on which to receive traffic")
-			fs.String("to", "", "Upstream address to which to to proxy traffic")
+			fs.Var(&stringListFlag{}, "to", "Upstream address(es) to which to proxy traffic; comma-separated or repeatable")
 			fs.String("root", "", "Directory to process PHP files from")
+			fs.String("lb-policy", "round_robin", "Load balancing policy to use across multiple upstreams (round_robin, least_conn, ip_hash, random)")
+			fs.String("health-uri", "", "URI (path and optional query) to request for active upstream health checks")
+			fs.Duration("health-interval", 30*time.Second, "How often to perform active upstream health checks")
+			fs.Int("max-conns-per-upstream", 0, "Maximum simultaneous requests to allow per upstream (0 for no limit)")
+			fs.Bool("to-tls", false, "Use TLS when connecting to the upstream FastCGI server(s)")
+			fs.String("to-tls-ca", "", "Path to a PEM file of CA certificates to trust for the upstream TLS connection")
+			fs.String("to-tls-client-cert", "", "Path to a client certificate PEM file for mutual TLS to the upstream")
+			fs.String("to-tls-client-key", "", "Path to the client certificate's key PEM file for mutual TLS to the upstream")
+			fs.String("to-tls-server-name", "", "Server name to verify in the upstream's TLS certificate, if different from its address")
+			fs.String("unix-socket-mode", "", "Expected permissions of the upstream unix socket(s), e.g. 0660; verified before dialing")
+			fs.String("index", "index.php", "The name of the front controller index file")
+			fs.Var(&stringListFlag{}, "ext", "File extension(s) to execute as PHP; comma-separated or repeatable (default .php)")
+			fs.Var(&stringListFlag{}, "try-files", "File(s) to try, in order, when rewriting requests; replaces the default list, and the index file is not appended to it; comma-separated or repeatable")
+			fs.Var(&stringListFlag{}, "env", "Environment variable(s) to set for the FastCGI process, as KEY=VALUE; comma-separated or repeatable")
+			fs.Bool("access-log", false, "Enable the access log")
+			fs.String("access-log-format", "console", "Encoding to use for the access log (console or json)")
+			fs.Bool("metrics", false, "Enable the admin API and expose Prometheus metrics at /metrics")
 			return fs
 		}(),
 	})
 }
 
+// stringListFlag collects one or more string values, given either as a
+// comma-separated list or by repeating the flag.
+type stringListFlag []string
+
+func (t *stringListFlag) String() string { return strings.Join(*t, ",") }
+
+func (t *stringListFlag) Set(value string) error {
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			*t = append(*t, addr)
+		}
+	}
+	return nil
+}
+
+// splitNonEmpty splits s by sep, trims whitespace from each part, and
+// omits empty parts; it returns nil if no parts remain.
+func splitNonEmpty(s string, sep string) []string {
+	var result []string
+	for _, part := range strings.Split(s, sep) {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+// phpFastCGIOptions holds the less commonly-used settings for
+// processPHPFastCGI, so that the function signature doesn't grow
+// unbounded as more flags are added to the command.
+type phpFastCGIOptions struct {
+	lbPolicy            string
+	healthURI           string
+	healthInterval      time.Duration
+	maxConnsPerUpstream int
+
+	toTLS           bool
+	toTLSCA         string
+	toTLSClientCert string
+	toTLSClientKey  string
+	toTLSServerName string
+	unixSocketMode  string
+
+	index      string
+	extensions []string
+	tryFiles   []string
+	env        []string
+
+	accessLog       bool
+	accessLogFormat string
+	metrics         bool
+}
+
 func cmdPHPFastCGI(fs caddycmd.Flags) (int, error) {
 	caddy.TrapSignals()
 
@@ -69,7 +169,27 @@ func cmdPHPFastCGI(fs caddycmd.Flags) (int, error) {
 	to := fs.String("to")
 	root := fs.String("root")
 
-	fromAddr, toAddr, cfg, err := processPHPFastCGI(from, to, root)
+	opts := phpFastCGIOptions{
+		lbPolicy:            fs.String("lb-policy"),
+		healthURI:           fs.String("health-uri"),
+		healthInterval:      fs.Duration("health-interval"),
+		maxConnsPerUpstream: fs.Int("max-conns-per-upstream"),
+		toTLS:               fs.Bool("to-tls"),
+		toTLSCA:             fs.String("to-tls-ca"),
+		toTLSClientCert:     fs.String("to-tls-client-cert"),
+		toTLSClientKey:      fs.String("to-tls-client-key"),
+		toTLSServerName:     fs.String("to-tls-server-name"),
+		unixSocketMode:      fs.String("unix-socket-mode"),
+		index:               fs.String("index"),
+		extensions:          splitNonEmpty(fs.String("ext"), ","),
+		tryFiles:            splitNonEmpty(fs.String("try-files"), ","),
+		env:                 splitNonEmpty(fs.String("env"), ","),
+		accessLog:           fs.Bool("access-log"),
+		accessLogFormat:     fs.String("access-log-format"),
+		metrics:             fs.Bool("metrics"),
+	}
+
+	fromAddr, toAddrs, cfg, err := processPHPFastCGI(from, to, root, opts)
 	if err != nil {
 		return caddy.ExitCodeFailedStartup, err
 	}
@@ -79,12 +199,16 @@ func cmdPHPFastCGI(fs caddycmd.Flags) (int, error) {
 		return caddy.ExitCodeFailedStartup, err
 	}
 
-	fmt.Printf("Caddy proxying PHP FastCGI %s -> %s\n", fromAddr.String(), toAddr.String())
+	toStrs := make([]string, len(toAddrs))
+	for i, addr := range toAddrs {
+		toStrs[i] = addr.String()
+	}
+	fmt.Printf("Caddy proxying PHP FastCGI %s -> %s\n", fromAddr.String(), strings.Join(toStrs, ", "))
 
 	select {}
 }
 
-func processPHPFastCGI(from string, to string, root string) (httpcaddyfile.Address, httpcaddyfile.Address, *caddy.Config, error, ) {
+func processPHPFastCGI(from string, to string, root string, opts phpFastCGIOptions) (httpcaddyfile.Address, []httpcaddyfile.Address, *caddy.Config, error) {
 	var err error
 
 	httpPort := strconv.Itoa(caddyhttp.DefaultHTTPPort)
@@ -92,22 +216,22 @@ func processPHPFastCGI(from string, to string, root string) (httpcaddyfile.Addre
 	fastCGIPort := strconv.Itoa(DefaultFastCGIPort)
 
 	fromAddr := httpcaddyfile.Address{}
-	toAddr := httpcaddyfile.Address{}
+	var toAddrs []httpcaddyfile.Address
 
 	if to == "" {
-		return fromAddr, toAddr, nil, fmt.Errorf("--to is required")
+		return fromAddr, toAddrs, nil, fmt.Errorf("--to is required")
 	}
 	if root == "" {
-		return fromAddr, toAddr, nil, fmt.Errorf("--to is required")
+		return fromAddr, toAddrs, nil, fmt.Errorf("--root is required")
 	}
 
 	// set up the downstream address; assume missing information from given parts
 	fromAddr, err = httpcaddyfile.ParseAddress(from)
 	if err != nil {
-		return fromAddr, toAddr, nil, fmt.Errorf("invalid downstream address %s: %v", from, err)
+		return fromAddr, toAddrs, nil, fmt.Errorf("invalid downstream address %s: %v", from, err)
 	}
 	if fromAddr.Path != "" {
-		return fromAddr, toAddr, nil, fmt.Errorf("paths are not allowed: %s", from)
+		return fromAddr, toAddrs, nil, fmt.Errorf("paths are not allowed: %s", from)
 	}
 	if fromAddr.Port == "" {
 		if fromAddr.Scheme == "http" {
@@ -124,36 +248,112 @@ func processPHPFastCGI(from string, to string, root string) (httpcaddyfile.Addre
 		}
 	}
 
-	// set up the upstream address; assume missing information from given parts
-	toAddr, err = httpcaddyfile.ParseAddress(to)
-	if err != nil {
-		return fromAddr, toAddr, nil, fmt.Errorf("invalid upstream address %s: %v", to, err)
+	// parse the expected unix socket permissions, if given
+	var unixSocketMode os.FileMode
+	if opts.unixSocketMode != "" {
+		mode, err := strconv.ParseUint(opts.unixSocketMode, 8, 32)
+		if err != nil {
+			return fromAddr, toAddrs, nil, fmt.Errorf("invalid --unix-socket-mode %s: %v", opts.unixSocketMode, err)
+		}
+		unixSocketMode = os.FileMode(mode)
 	}
-	if toAddr.Path != "" {
-		return fromAddr, toAddr, nil, fmt.Errorf("paths are not allowed: %s", to)
+
+	// set up the upstream addresses; assume missing information from given parts
+	for _, toRaw := range strings.Split(to, ",") {
+		toRaw = strings.TrimSpace(toRaw)
+		if toRaw == "" {
+			continue
+		}
+		toAddr, err := httpcaddyfile.ParseAddress(toRaw)
+		if err != nil {
+			return fromAddr, toAddrs, nil, fmt.Errorf("invalid upstream address %s: %v", toRaw, err)
+		}
+		switch toAddr.Scheme {
+		case "unix":
+			// the socket path may end up in the host or the path, depending
+			// on how many slashes followed the scheme
+			sockPath := toAddr.Path
+			if sockPath == "" {
+				sockPath = toAddr.Host
+			}
+			if sockPath == "" {
+				return fromAddr, toAddrs, nil, fmt.Errorf("missing unix socket path: %s", toRaw)
+			}
+			if err := checkUnixSocket(sockPath, unixSocketMode); err != nil {
+				return fromAddr, toAddrs, nil, err
+			}
+			toAddr.Host, toAddr.Path, toAddr.Port = sockPath, "", ""
+		case "", "fastcgi":
+			if toAddr.Path != "" {
+				return fromAddr, toAddrs, nil, fmt.Errorf("paths are not allowed: %s", toRaw)
+			}
+			toAddr.Scheme = "fastcgi"
+			if toAddr.Port == "" {
+				toAddr.Port = fastCGIPort
+			}
+		default:
+			return fromAddr, toAddrs, nil, fmt.Errorf(
+				"invalid upstream scheme %s: should be omitted, 'fastcgi' or 'unix'", toAddr.Scheme)
+		}
+		toAddrs = append(toAddrs, toAddr)
 	}
-	if toAddr.Port == "" {
-		toAddr.Port = fastCGIPort
+	if len(toAddrs) == 0 {
+		return fromAddr, toAddrs, nil, fmt.Errorf("--to is required")
 	}
-	switch toAddr.Scheme {
-	case "unix":
-	case "":
-		toAddr.Scheme = "fastcgi"
-	default:
-		return fromAddr, toAddr, nil, fmt.Errorf(
-			"invalid upstream scheme %s: should be omitted, 'fastcgi' or 'unix'", toAddr.Scheme)
+
+	// build the upstream TLS config, if the upstream(s) expect TLS; any
+	// --to-tls-* sub-flag implies --to-tls, so a flag isn't silently
+	// dropped if the user forgets to pass --to-tls itself
+	toTLS := opts.toTLS || opts.toTLSCA != "" || opts.toTLSClientCert != "" ||
+		opts.toTLSClientKey != "" || opts.toTLSServerName != ""
+
+	var upstreamTLS *reverseproxy.TLSConfig
+	if toTLS {
+		upstreamTLS = &reverseproxy.TLSConfig{}
+		if opts.toTLSCA != "" {
+			upstreamTLS.RootCAPEMFiles = []string{opts.toTLSCA}
+		}
+		if opts.toTLSClientCert != "" || opts.toTLSClientKey != "" {
+			if opts.toTLSClientCert == "" || opts.toTLSClientKey == "" {
+				return fromAddr, toAddrs, nil, fmt.Errorf(
+					"--to-tls-client-cert and --to-tls-client-key must be given together")
+			}
+			upstreamTLS.ClientCertificateFile = opts.toTLSClientCert
+			upstreamTLS.ClientCertificateKeyFile = opts.toTLSClientKey
+		}
+		if opts.toTLSServerName != "" {
+			upstreamTLS.ServerName = opts.toTLSServerName
+		}
+	}
+
+	// parse the environment variables to pass to the FastCGI process
+	envVars := make(map[string]string, len(opts.env))
+	for _, kv := range opts.env {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fromAddr, toAddrs, nil, fmt.Errorf("invalid --env %s: expected KEY=VALUE", kv)
+		}
+		envVars[key] = value
 	}
 
 	// set up the transport for FastCGI, and specifically PHP
 	fcgiTransport := Transport{
-		Root: root,
+		Root:    root,
+		TLS:     upstreamTLS,
+		EnvVars: envVars,
 	}
 
 	// set up the set of file extensions allowed to execute PHP code
-	extensions := []string{".php"}
+	extensions := opts.extensions
+	if len(extensions) == 0 {
+		extensions = []string{".php"}
+	}
 
-	// set the default index file for the try_files rewrites
-	indexFile := "index.php"
+	// set the index file for the try_files rewrites
+	indexFile := opts.index
+	if indexFile == "" {
+		indexFile = "index.php"
+	}
 
 	// set up a route list that we'll append to
 	routes := caddyhttp.RouteList{}
@@ -183,8 +383,11 @@ func processPHPFastCGI(from string, to string, root string) (httpcaddyfile.Addre
 		HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(redirHandler, "handler", "static_response", nil)},
 	}
 
-	// Use a reasonable default
-	tryFiles := []string{"{http.request.uri.path}", "{http.request.uri.path}/" + indexFile, indexFile}
+	// use a reasonable default unless the user gave their own try_files list
+	tryFiles := opts.tryFiles
+	if len(tryFiles) == 0 {
+		tryFiles = []string{"{http.request.uri.path}", "{http.request.uri.path}/" + indexFile, indexFile}
+	}
 
 	// route to rewrite to PHP index file
 	rewriteMatcherSet := caddy.ModuleMap{
@@ -203,10 +406,64 @@ func processPHPFastCGI(from string, to string, root string) (httpcaddyfile.Addre
 
 	routes = append(routes, redirRoute, rewriteRoute)
 
+	// build the pool of upstreams to proxy to, one per --to address
+	upstreams := make(reverseproxy.UpstreamPool, 0, len(toAddrs))
+	for _, toAddr := range toAddrs {
+		dial := net.JoinHostPort(toAddr.Host, toAddr.Port)
+		if toAddr.Scheme == "unix" {
+			dial = "unix/" + toAddr.Host
+		}
+		upstreams = append(upstreams, &reverseproxy.Upstream{
+			Dial:        dial,
+			MaxRequests: opts.maxConnsPerUpstream,
+		})
+	}
+
+	// when more than one upstream is configured, set up load balancing
+	// using the requested policy (round_robin by default); a single
+	// upstream has nothing to balance across, so --lb-policy is a no-op
+	var loadBalancing *reverseproxy.LoadBalancing
+	if len(upstreams) > 1 {
+		lbPolicy := opts.lbPolicy
+		if lbPolicy == "" {
+			lbPolicy = "round_robin"
+		}
+		var selector caddy.Module
+		switch lbPolicy {
+		case "round_robin":
+			selector = reverseproxy.RoundRobinSelection{}
+		case "least_conn":
+			selector = reverseproxy.LeastConnSelection{}
+		case "ip_hash":
+			selector = reverseproxy.IPHashSelection{}
+		case "random":
+			selector = reverseproxy.RandomSelection{}
+		default:
+			return fromAddr, toAddrs, nil, fmt.Errorf(
+				"invalid --lb-policy %s: should be 'round_robin', 'least_conn', 'ip_hash', or 'random'", lbPolicy)
+		}
+		loadBalancing = &reverseproxy.LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(selector, "policy", lbPolicy, nil),
+		}
+	}
+
+	// configure active health checks against the upstream pool, if requested
+	var healthChecks *reverseproxy.HealthChecks
+	if opts.healthURI != "" {
+		healthChecks = &reverseproxy.HealthChecks{
+			Active: &reverseproxy.ActiveHealthChecks{
+				URI:      opts.healthURI,
+				Interval: caddy.Duration(opts.healthInterval),
+			},
+		}
+	}
+
 	// create the reverse proxy handler which uses our FastCGI transport
 	rpHandler := &reverseproxy.Handler{
-		TransportRaw: caddyconfig.JSONModuleObject(fcgiTransport, "protocol", "fastcgi", nil),
-		Upstreams:    reverseproxy.UpstreamPool{{Dial: net.JoinHostPort(toAddr.Host, toAddr.Port)}},
+		TransportRaw:  caddyconfig.JSONModuleObject(fcgiTransport, "protocol", "fastcgi", nil),
+		Upstreams:     upstreams,
+		LoadBalancing: loadBalancing,
+		HealthChecks:  healthChecks,
 	}
 
 	// route to actually reverse proxy requests to PHP files;
@@ -238,26 +495,88 @@ func processPHPFastCGI(from string, to string, root string) (httpcaddyfile.Addre
 		Routes: caddyhttp.RouteList{
 			caddyhttp.Route{
 				MatcherSetsRaw: []caddy.ModuleMap{hostMatcherSet},
-				HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(subroute, "handler", "subroute", nil)},
+				HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(subroute, "handler", "subroute", nil)},
 			},
 		},
 		Listen: []string{":" + fromAddr.Port},
 	}
 
+	// validate --access-log-format regardless of whether --access-log is
+	// set, so a typo isn't silently ignored until the flag is also passed
+	var encoder caddy.Module
+	logFormat := opts.accessLogFormat
+	if logFormat == "" {
+		logFormat = "console"
+	}
+	switch logFormat {
+	case "console":
+		encoder = logging.ConsoleEncoder{}
+	case "json":
+		encoder = logging.JSONEncoder{}
+	default:
+		return fromAddr, toAddrs, nil, fmt.Errorf(
+			"invalid --access-log-format %s: should be 'console' or 'json'", opts.accessLogFormat)
+	}
+
+	// enable the access log for this server, using the requested encoding
+	var accessLogging *caddy.Logging
+	if opts.accessLog {
+		server.Logs = &caddyhttp.ServerLogConfig{}
+		accessLogging = &caddy.Logging{
+			Logs: map[string]*caddy.CustomLog{
+				"default": {
+					BaseLog: caddy.BaseLog{
+						EncoderRaw: caddyconfig.JSONModuleObject(encoder, "format", logFormat, nil),
+					},
+				},
+			},
+		}
+	}
+
 	httpApp := caddyhttp.App{
 		Servers: map[string]*caddyhttp.Server{"proxy": server},
 	}
 
+	// the admin API (and its /metrics endpoint) is disabled by default for
+	// this quick-start command; --metrics turns it back on
+	admin := &caddy.AdminConfig{Disabled: true}
+	if opts.metrics {
+		admin = &caddy.AdminConfig{Metrics: &caddy.Metrics{}}
+	}
+
 	cfg := &caddy.Config{
-		Admin: &caddy.AdminConfig{Disabled: true},
+		Admin:   admin,
+		Logging: accessLogging,
 		AppsRaw: caddy.ModuleMap{
 			"http": caddyconfig.JSON(httpApp, nil),
 		},
 	}
-	return fromAddr, toAddr, cfg, err
+	return fromAddr, toAddrs, cfg, err
 }
 
 const (
 	// DefaultFastCGIPort is the default port for FastCGI (PHP).
 	DefaultFastCGIPort = 9000
 )
+
+// checkUnixSocket verifies that the unix socket at path exists and is
+// reachable, and, if expectedMode is nonzero, that its permissions match.
+// It returns a descriptive error if not, so that misconfigurations (e.g. a
+// PHP-FPM pool that hasn't started yet) are caught at startup rather than
+// on the first request.
+func checkUnixSocket(path string, expectedMode os.FileMode) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("upstream unix socket %s is not reachable: %v", path, err)
+	}
+	if expectedMode != 0 && info.Mode().Perm() != expectedMode.Perm() {
+		return fmt.Errorf("upstream unix socket %s has mode %s, expected %s",
+			path, info.Mode().Perm(), expectedMode.Perm())
+	}
+	conn, err := net.DialTimeout("unix", path, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("upstream unix socket %s is not reachable: %v", path, err)
+	}
+	conn.Close()
+	return nil
+}
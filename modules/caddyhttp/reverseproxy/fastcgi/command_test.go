@@ -1,30 +1,273 @@
 package fastcgi
 
-import "testing"
+import (
+	"encoding/json"
+	"maps"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// subroute digs the subroute handler out of the generated config, giving
+// access to the redirect, rewrite, and reverse_proxy routes it contains.
+func subroute(t *testing.T, cfg *caddy.Config) caddyhttp.Subroute {
+	t.Helper()
+
+	var httpApp caddyhttp.App
+	if err := json.Unmarshal(cfg.AppsRaw["http"], &httpApp); err != nil {
+		t.Fatal(err)
+	}
+	server := httpApp.Servers["proxy"]
+
+	var sub caddyhttp.Subroute
+	if err := json.Unmarshal(server.Routes[0].HandlersRaw[0], &sub); err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+// reverseProxyHandler decodes the reverse_proxy handler (the last route in
+// the subroute) out of the generated config.
+func reverseProxyHandler(t *testing.T, cfg *caddy.Config) reverseproxy.Handler {
+	t.Helper()
+
+	sub := subroute(t, cfg)
+	rpRoute := sub.Routes[len(sub.Routes)-1]
+	var rp reverseproxy.Handler
+	if err := json.Unmarshal(rpRoute.HandlersRaw[0], &rp); err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+// firstUpstream decodes the first upstream out of the reverse_proxy
+// handler buried in the generated config.
+func firstUpstream(t *testing.T, cfg *caddy.Config) *reverseproxy.Upstream {
+	t.Helper()
+
+	rp := reverseProxyHandler(t, cfg)
+	if len(rp.Upstreams) == 0 {
+		t.Fatal("expected at least one upstream in the generated config")
+	}
+	return rp.Upstreams[0]
+}
+
+// firstUpstreamDial digs the Dial address of the first upstream out of the
+// reverse_proxy handler buried in the generated config, so tests can assert
+// on the exact string that ends up on the wire.
+func firstUpstreamDial(t *testing.T, cfg *caddy.Config) string {
+	t.Helper()
+	return firstUpstream(t, cfg).Dial
+}
+
+// fcgiTransport decodes the FastCGI Transport out of the reverse_proxy
+// handler buried in the generated config.
+func fcgiTransport(t *testing.T, cfg *caddy.Config) Transport {
+	t.Helper()
+
+	rp := reverseProxyHandler(t, cfg)
+	var transport Transport
+	if err := json.Unmarshal(rp.TransportRaw, &transport); err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+// rewriteTryFiles decodes the try_files list used by the rewrite route
+// (the second route in the subroute) out of the generated config.
+func rewriteTryFiles(t *testing.T, cfg *caddy.Config) []string {
+	t.Helper()
+
+	sub := subroute(t, cfg)
+	rewriteRoute := sub.Routes[1]
+	var matcher fileserver.MatchFile
+	if err := json.Unmarshal(rewriteRoute.MatcherSetsRaw[0]["file"], &matcher); err != nil {
+		t.Fatal(err)
+	}
+	return matcher.TryFiles
+}
 
 func TestProcessPHPFastCGI(t *testing.T) {
-	_, _, _, err := processPHPFastCGI("app.example.com", "localhost:9000", "/var/www/html")
+	_, _, _, err := processPHPFastCGI("app.example.com", "localhost:9000", "/var/www/html", phpFastCGIOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, _, _, err = processPHPFastCGI("app.example.com", ":9000", "/var/www/html")
+	_, _, _, err = processPHPFastCGI("app.example.com", ":9000", "/var/www/html", phpFastCGIOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, _, _, err = processPHPFastCGI("http://localhost:1234", "external.example.com:9000", "/var/www/html")
+	_, _, _, err = processPHPFastCGI("http://localhost:1234", "external.example.com:9000", "/var/www/html", phpFastCGIOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, _, _, err = processPHPFastCGI("app.example.com", ":9000", "")
+	_, _, _, err = processPHPFastCGI("app.example.com", ":9000", "", phpFastCGIOptions{})
 	if err == nil {
 		t.Fatal("expected complaint about missing 'root', but did not return error")
 	}
 
-	_, _, _, err = processPHPFastCGI("app.example.com", "http://localhost", "/var/www/html")
+	_, _, _, err = processPHPFastCGI("app.example.com", "http://localhost", "/var/www/html", phpFastCGIOptions{})
 	if err == nil {
 		t.Fatal("expected complaint about invalid 'to', but did not return error")
 	}
+
+	_, toAddrs, _, err := processPHPFastCGI("app.example.com", "10.0.0.1:9000,10.0.0.2:9000", "/var/www/html", phpFastCGIOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toAddrs) != 2 {
+		t.Fatalf("expected 2 upstream addresses, got %d", len(toAddrs))
+	}
+
+	_, _, _, err = processPHPFastCGI("app.example.com", "10.0.0.1:9000, 10.0.0.2:9000", "/var/www/html", phpFastCGIOptions{lbPolicy: "least_conn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = processPHPFastCGI("app.example.com", "10.0.0.1:9000,10.0.0.2:9000", "/var/www/html", phpFastCGIOptions{lbPolicy: "bogus"})
+	if err == nil {
+		t.Fatal("expected complaint about invalid 'lb-policy', but did not return error")
+	}
+
+	// a single upstream has nothing to balance across, so an invalid
+	// --lb-policy is simply ignored rather than rejected
+	_, _, _, err = processPHPFastCGI("app.example.com", "10.0.0.1:9000", "/var/www/html", phpFastCGIOptions{lbPolicy: "bogus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, cfg, err := processPHPFastCGI("app.example.com", "10.0.0.1:9000,10.0.0.2:9000", "/var/www/html", phpFastCGIOptions{
+		healthURI:           "/healthz",
+		healthInterval:      15 * time.Second,
+		maxConnsPerUpstream: 42,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := reverseProxyHandler(t, cfg)
+	if rp.HealthChecks == nil || rp.HealthChecks.Active == nil {
+		t.Fatal("expected active health checks to be configured")
+	}
+	if rp.HealthChecks.Active.URI != "/healthz" {
+		t.Fatalf("expected health check URI %q, got %q", "/healthz", rp.HealthChecks.Active.URI)
+	}
+	if time.Duration(rp.HealthChecks.Active.Interval) != 15*time.Second {
+		t.Fatalf("expected health check interval %s, got %s", 15*time.Second, time.Duration(rp.HealthChecks.Active.Interval))
+	}
+	for _, upstream := range rp.Upstreams {
+		if upstream.MaxRequests != 42 {
+			t.Fatalf("expected MaxRequests 42, got %d", upstream.MaxRequests)
+		}
+	}
+
+	_, _, _, err = processPHPFastCGI("app.example.com", "unix:///does/not/exist.sock", "/var/www/html", phpFastCGIOptions{})
+	if err == nil {
+		t.Fatal("expected complaint about unreachable unix socket, but did not return error")
+	}
+
+	sockPath := filepath.Join(t.TempDir(), "php-fpm.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, _, cfg, err = processPHPFastCGI("app.example.com", "unix://"+sockPath, "/var/www/html", phpFastCGIOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "unix/"+sockPath, firstUpstreamDial(t, cfg); got != want {
+		t.Fatalf("expected upstream dial %q, got %q", want, got)
+	}
+
+	_, _, _, err = processPHPFastCGI("app.example.com", "10.0.0.1:9000", "/var/www/html", phpFastCGIOptions{
+		toTLS:           true,
+		toTLSClientCert: "/etc/caddy/client.pem",
+	})
+	if err == nil {
+		t.Fatal("expected complaint about incomplete mTLS client cert/key pair, but did not return error")
+	}
+
+	_, _, cfg, err = processPHPFastCGI("app.example.com", "10.0.0.1:9000", "/var/www/html", phpFastCGIOptions{
+		toTLSClientCert: "/etc/caddy/client.pem",
+		toTLSClientKey:  "/etc/caddy/client-key.pem",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := fcgiTransport(t, cfg)
+	if transport.TLS == nil {
+		t.Fatal("expected TLS to be enabled implicitly by --to-tls-client-cert/--to-tls-client-key")
+	}
+	if transport.TLS.ClientCertificateFile != "/etc/caddy/client.pem" {
+		t.Fatalf("expected client certificate file %q, got %q", "/etc/caddy/client.pem", transport.TLS.ClientCertificateFile)
+	}
+	if transport.TLS.ClientCertificateKeyFile != "/etc/caddy/client-key.pem" {
+		t.Fatalf("expected client certificate key file %q, got %q", "/etc/caddy/client-key.pem", transport.TLS.ClientCertificateKeyFile)
+	}
+
+	_, _, cfg, err = processPHPFastCGI("app.example.com", "localhost:9000", "/var/www/html", phpFastCGIOptions{
+		index:      "app.php",
+		extensions: []string{".php", ".phtml"},
+		tryFiles:   []string{"{http.request.uri.path}", "app.php"},
+		env:        []string{"APP_ENV=production"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport = fcgiTransport(t, cfg)
+	if want := []string{".php", ".phtml"}; !slices.Equal(transport.SplitPath, want) {
+		t.Fatalf("expected SplitPath %v, got %v", want, transport.SplitPath)
+	}
+	if want := map[string]string{"APP_ENV": "production"}; !maps.Equal(transport.EnvVars, want) {
+		t.Fatalf("expected EnvVars %v, got %v", want, transport.EnvVars)
+	}
+	if want := []string{"{http.request.uri.path}", "app.php"}; !slices.Equal(rewriteTryFiles(t, cfg), want) {
+		t.Fatalf("expected TryFiles %v, got %v", want, rewriteTryFiles(t, cfg))
+	}
+
+	_, _, _, err = processPHPFastCGI("app.example.com", "localhost:9000", "/var/www/html", phpFastCGIOptions{
+		env: []string{"MISSING_EQUALS_SIGN"},
+	})
+	if err == nil {
+		t.Fatal("expected complaint about invalid 'env', but did not return error")
+	}
+
+	_, _, cfg, err = processPHPFastCGI("app.example.com", "localhost:9000", "/var/www/html", phpFastCGIOptions{
+		accessLog:       true,
+		accessLogFormat: "json",
+		metrics:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Admin == nil || cfg.Admin.Disabled {
+		t.Fatal("expected the admin API to be enabled when --metrics is set")
+	}
+	if cfg.Logging == nil {
+		t.Fatal("expected logging to be configured when --access-log is set")
+	}
+
+	_, _, _, err = processPHPFastCGI("app.example.com", "localhost:9000", "/var/www/html", phpFastCGIOptions{
+		accessLog:       true,
+		accessLogFormat: "bogus",
+	})
+	if err == nil {
+		t.Fatal("expected complaint about invalid 'access-log-format', but did not return error")
+	}
+
+	_, _, _, err = processPHPFastCGI("app.example.com", "localhost:9000", "/var/www/html", phpFastCGIOptions{
+		accessLogFormat: "bogus",
+	})
+	if err == nil {
+		t.Fatal("expected complaint about invalid 'access-log-format' even without --access-log, but did not return error")
+	}
 }